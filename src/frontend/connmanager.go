@@ -0,0 +1,255 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/plugin/grpctrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	dialTimeout        = 5 * time.Second
+	dialMaxElapsed     = 30 * time.Second
+	healthCheckPeriod  = 10 * time.Second
+	healthCheckTimeout = 3 * time.Second
+)
+
+// connManagerConfig describes how to reach one backend service, including optional
+// TLS/mTLS material. CAFile/CertFile/KeyFile are read from
+// <NAME>_SERVICE_TLS_CA/_CERT/_KEY; leaving them unset dials insecurely, which is
+// still the default for the demo's in-cluster traffic.
+type connManagerConfig struct {
+	Name string // used for logging, e.g. "cart"
+	Addr string
+
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// connManager owns a single backend gRPC connection and keeps it healthy: it dials
+// with exponential backoff and jitter, keeps client-side keepalives on, and runs a
+// health-check goroutine against grpc.health.v1.Health/Check so handlers can serve
+// degraded responses (e.g. skip recommendations/ads) instead of 500-ing when a
+// backend is down.
+type connManager struct {
+	cfg  connManagerConfig
+	log  logrus.FieldLogger
+	conn *grpc.ClientConn
+
+	mu      sync.RWMutex
+	healthy bool
+}
+
+// newConnManager dials addr (retrying with backoff up to dialMaxElapsed) and starts
+// the background health-check loop.
+func newConnManager(ctx context.Context, log logrus.FieldLogger, cfg connManagerConfig) (*connManager, error) {
+	m := &connManager{cfg: cfg, log: log}
+
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+	m.healthy = true
+
+	go m.watchHealth(ctx)
+	return m, nil
+}
+
+func (m *connManager) dial(ctx context.Context) (*grpc.ClientConn, error) {
+	creds, err := m.transportCreds()
+	if err != nil {
+		return nil, errors.Wrapf(err, "grpc: building TLS credentials for %s", m.cfg.Name)
+	}
+
+	opts := []grpc.DialOption{
+		creds,
+		// WithBlock (plus the per-attempt timeout below) is what makes a down
+		// backend actually surface as a dial error instead of DialContext handing
+		// back an unconnected ClientConn immediately - without it the backoff loop
+		// below never sees a failure to retry.
+		grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(grpctrace.UnaryClientInterceptor(global.Tracer("Frontend"))),
+		grpc.WithStreamInterceptor(grpctrace.StreamClientInterceptor(global.Tracer("Frontend"))),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                20 * time.Second,
+			Timeout:             5 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = dialMaxElapsed
+
+	var conn *grpc.ClientConn
+	err = backoff.Retry(func() error {
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+
+		c, dialErr := grpc.DialContext(dialCtx, m.cfg.Addr, opts...)
+		if dialErr != nil {
+			m.log.WithError(dialErr).Warnf("grpc: retrying connection to %s (%s)", m.cfg.Name, m.cfg.Addr)
+			return dialErr
+		}
+		conn = c
+		return nil
+	}, backoff.WithContext(b, ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "grpc: failed to connect to %s (%s)", m.cfg.Name, m.cfg.Addr)
+	}
+	return conn, nil
+}
+
+func (m *connManager) transportCreds() (grpc.DialOption, error) {
+	if m.cfg.CAFile == "" && m.cfg.CertFile == "" && m.cfg.KeyFile == "" {
+		return grpc.WithInsecure(), nil
+	}
+
+	tlsCfg, err := buildTLSConfig(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)), nil
+}
+
+// buildTLSConfig assembles the *tls.Config for a backend from its configured CA
+// bundle and/or client cert/key. Split out of transportCreds so the nil-vs-empty
+// RootCAs behavior - staying nil (system pool) unless a CA bundle was explicitly
+// configured, since an mTLS setup with only *_TLS_CERT/*_TLS_KEY is expected to
+// verify the server against the system roots - can be unit tested directly.
+func buildTLSConfig(cfg connManagerConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+	if cfg.CAFile != "" {
+		pool := x509.NewCertPool()
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading CA bundle %s", cfg.CAFile)
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.Errorf("%s: both *_TLS_CERT and *_TLS_KEY must be set to use a client certificate, got cert=%q key=%q", cfg.Name, cfg.CertFile, cfg.KeyFile)
+	}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading client cert/key for %s", cfg.Name)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// watchHealth polls grpc.health.v1.Health/Check against the backend until ctx is
+// done, flipping Healthy() on any status change.
+func (m *connManager) watchHealth(ctx context.Context) {
+	client := grpc_health_v1.NewHealthClient(m.Conn())
+	ticker := time.NewTicker(healthCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			resp, err := client.Check(checkCtx, &grpc_health_v1.HealthCheckRequest{})
+			cancel()
+
+			healthy := err == nil && resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING
+			if healthy != m.Healthy() {
+				m.log.Infof("grpc: %s health changed to healthy=%v", m.cfg.Name, healthy)
+			}
+			m.mu.Lock()
+			m.healthy = healthy
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Conn returns the underlying connection for building a service client. Handlers
+// should check Healthy() before relying on it for non-critical calls (recommendations,
+// ads) so a single flaky backend degrades the page instead of failing the request.
+func (m *connManager) Conn() *grpc.ClientConn {
+	return m.conn
+}
+
+// Healthy reports whether the most recent health check against this backend succeeded.
+func (m *connManager) Healthy() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.healthy
+}
+
+type ctxKeyDegradedServices struct{}
+
+// degradationHandler consults the non-critical backends' connManagers on every
+// request and records which of them are currently unhealthy in the request
+// context, so handlers can skip those sections (e.g. recommendations, ads) instead
+// of failing the whole page when one flaky backend is down.
+type degradationHandler struct {
+	nonCritical map[string]*connManager
+	next        http.Handler
+}
+
+func newDegradationHandler(nonCritical map[string]*connManager, next http.Handler) http.Handler {
+	return &degradationHandler{nonCritical: nonCritical, next: next}
+}
+
+func (h *degradationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	degraded := map[string]bool{}
+	for name, mgr := range h.nonCritical {
+		if mgr.Conn() == nil || !mgr.Healthy() {
+			degraded[name] = true
+		}
+	}
+
+	ctx := r.Context()
+	if len(degraded) > 0 {
+		ctx = context.WithValue(ctx, ctxKeyDegradedServices{}, degraded)
+	}
+	h.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// isServiceDegraded reports whether name was marked unhealthy by degradationHandler
+// for this request. Handlers for non-critical backends (recommendations, ads) should
+// check this before calling out, and render without that section instead of 500-ing.
+func isServiceDegraded(ctx context.Context, name string) bool {
+	degraded, ok := ctx.Value(ctxKeyDegradedServices{}).(map[string]bool)
+	if !ok {
+		return false
+	}
+	return degraded[name]
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a throwaway self-signed cert/key pair under dir and
+// returns their paths, for exercising buildTLSConfig without real CA material.
+func writeTestCert(t *testing.T, dir, prefix string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: prefix},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating test certificate: %v", err)
+	}
+
+	certFile = filepath.Join(dir, prefix+".crt")
+	keyFile = filepath.Join(dir, prefix+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, bytes []byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("creating %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: bytes}); err != nil {
+		t.Fatalf("encoding %s: %v", path, err)
+	}
+}
+
+func TestBuildTLSConfig_NoCAFile_LeavesRootCAsNil(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "client")
+
+	cfg := connManagerConfig{Name: "cart", CertFile: certFile, KeyFile: keyFile}
+	tlsCfg, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if tlsCfg.RootCAs != nil {
+		t.Errorf("RootCAs = %v, want nil (system pool) when CAFile is unset", tlsCfg.RootCAs)
+	}
+	if len(tlsCfg.Certificates) != 1 {
+		t.Errorf("Certificates = %d entries, want 1", len(tlsCfg.Certificates))
+	}
+}
+
+func TestBuildTLSConfig_CAFileSet_PopulatesRootCAs(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := writeTestCert(t, dir, "ca")
+
+	cfg := connManagerConfig{Name: "cart", CAFile: caFile}
+	tlsCfg, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if tlsCfg.RootCAs == nil {
+		t.Fatal("RootCAs = nil, want a populated pool when CAFile is set")
+	}
+	if len(tlsCfg.RootCAs.Subjects()) != 1 {
+		t.Errorf("RootCAs contains %d subjects, want 1", len(tlsCfg.RootCAs.Subjects()))
+	}
+}
+
+func TestBuildTLSConfig_InvalidCAFile_Errors(t *testing.T) {
+	cfg := connManagerConfig{Name: "cart", CAFile: filepath.Join(t.TempDir(), "missing.pem")}
+	if _, err := buildTLSConfig(cfg); err == nil {
+		t.Error("buildTLSConfig with a missing CAFile: expected an error, got nil")
+	}
+}
+
+func TestBuildTLSConfig_HalfSpecifiedCertKey_Errors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "client")
+
+	cases := []struct {
+		name string
+		cfg  connManagerConfig
+	}{
+		{"cert without key", connManagerConfig{Name: "cart", CertFile: certFile}},
+		{"key without cert", connManagerConfig{Name: "cart", KeyFile: keyFile}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := buildTLSConfig(tc.cfg); err == nil {
+				t.Error("buildTLSConfig with a half-specified cert/key pair: expected an error, got nil")
+			}
+		})
+	}
+}
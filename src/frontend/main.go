@@ -19,26 +19,16 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
 
-	//"go.opentelemetry.io/otel/api/correlation"
-	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
-	"github.com/newrelic/opentelemetry-exporter-go/newrelic"
 	"go.opentelemetry.io/otel/api/global"
 	"go.opentelemetry.io/otel/api/key"
 	"go.opentelemetry.io/otel/api/metric"
 	"go.opentelemetry.io/otel/api/unit"
-	"go.opentelemetry.io/otel/exporters/trace/stdout"
-	"go.opentelemetry.io/otel/plugin/grpctrace"
-	"go.opentelemetry.io/otel/sdk/metric/batcher/ungrouped"
-	"go.opentelemetry.io/otel/sdk/metric/controller/push"
-	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
-	"go.opentelemetry.io/otel/sdk/trace"
 )
 
 const (
@@ -65,25 +55,25 @@ type ctxKeySessionID struct{}
 
 type frontendServer struct {
 	productCatalogSvcAddr string
-	productCatalogSvcConn *grpc.ClientConn
+	productCatalogSvc     *connManager
 
 	currencySvcAddr string
-	currencySvcConn *grpc.ClientConn
+	currencySvc     *connManager
 
 	cartSvcAddr string
-	cartSvcConn *grpc.ClientConn
+	cartSvc     *connManager
 
 	recommendationSvcAddr string
-	recommendationSvcConn *grpc.ClientConn
+	recommendationSvc     *connManager
 
 	checkoutSvcAddr string
-	checkoutSvcConn *grpc.ClientConn
+	checkoutSvc     *connManager
 
 	shippingSvcAddr string
-	shippingSvcConn *grpc.ClientConn
+	shippingSvc     *connManager
 
 	adSvcAddr string
-	adSvcConn *grpc.ClientConn
+	adSvc     *connManager
 }
 
 func main() {
@@ -120,13 +110,13 @@ func main() {
 	mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
 	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
 
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	svc.currencySvc = mustNewConnManager(ctx, log, "currency", "CURRENCY_SERVICE_ADDR", svc.currencySvcAddr)
+	svc.productCatalogSvc = mustNewConnManager(ctx, log, "productcatalog", "PRODUCT_CATALOG_SERVICE_ADDR", svc.productCatalogSvcAddr)
+	svc.cartSvc = mustNewConnManager(ctx, log, "cart", "CART_SERVICE_ADDR", svc.cartSvcAddr)
+	svc.recommendationSvc = mustNewConnManager(ctx, log, "recommendation", "RECOMMENDATION_SERVICE_ADDR", svc.recommendationSvcAddr)
+	svc.shippingSvc = mustNewConnManager(ctx, log, "shipping", "SHIPPING_SERVICE_ADDR", svc.shippingSvcAddr)
+	svc.checkoutSvc = mustNewConnManager(ctx, log, "checkout", "CHECKOUT_SERVICE_ADDR", svc.checkoutSvcAddr)
+	svc.adSvc = mustNewConnManager(ctx, log, "ad", "AD_SERVICE_ADDR", svc.adSvcAddr)
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
@@ -139,7 +129,7 @@ func main() {
 	r.HandleFunc("/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc("/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
-	r.HandleFunc("/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	r.HandleFunc("/_healthz", svc.healthzHandler)
 
 	meter := global.MeterProvider().Meter("Frontend")
 
@@ -179,75 +169,55 @@ func main() {
 		errorCount:     errorCount.Bind(hostKey),
 		next:           handler,
 	}
+	maybeStartMetricsServer(log) // expose /metrics for Prometheus, reading the same instruments above
+	handler = newDegradationHandler(map[string]*connManager{
+		"recommendation": svc.recommendationSvc,
+		"ad":             svc.adSvc,
+	}, handler) // mark non-critical backends as degraded instead of failing the request
+	handler = &propagationHandler{next: handler}   // extract trace context + baggage
 	handler = &logHandler{log: log, next: handler} // add logging
 	handler = ensureSessionID(handler)             // add session ID
 	log.Infof("starting server on " + addr + ":" + srvPort)
 	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
 }
 
-func checkEnvVar(s string) bool {
-	return s != "" && s != "<no value>"
+// backends returns every backend connManager, labeled by the same short name used
+// as its connManagerConfig.Name for logging.
+func (fe *frontendServer) backends() map[string]*connManager {
+	return map[string]*connManager{
+		"productcatalog": fe.productCatalogSvc,
+		"currency":       fe.currencySvc,
+		"cart":           fe.cartSvc,
+		"recommendation": fe.recommendationSvc,
+		"checkout":       fe.checkoutSvc,
+		"shipping":       fe.shippingSvc,
+		"ad":             fe.adSvc,
+	}
 }
 
-var pusher *push.Controller
-
-func initTracing(log logrus.FieldLogger) {
-	// Create stdout exporter to be able to retrieve
-	// the collected spans.
-	api_key := os.Getenv("NEW_RELIC_API_KEY")
-	if checkEnvVar(api_key) {
-		log.Info("Using New Relic API KEY: " + api_key)
-		exporter, err := newrelic.NewExporter(
-			"Frontend",
-			api_key,
-			func(cfg *telemetry.Config) {
-				metricURL := os.Getenv("NEW_RELIC_METRIC_URL")
-				if checkEnvVar(metricURL) {
-					log.Info("Setting metric export endpoint to " + metricURL)
-					cfg.MetricsURLOverride = metricURL
-				}
-				traceURL := os.Getenv("NEW_RELIC_TRACE_URL")
-				if checkEnvVar(traceURL) {
-					log.Info("Setting trace export endpoint to " + traceURL)
-					cfg.SpansURLOverride = traceURL
-				}
-			},
-		)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		tp, err := trace.NewProvider(trace.WithSyncer(exporter))
-		if err != nil {
-			log.Fatal(err)
-		}
-		// TODO: enable these piecemeal based on available urls
-		global.SetTraceProvider(tp)
-
-		selector := simple.NewWithExactMeasure()
-		batcher := ungrouped.New(selector, true)
-		pusher = push.New(batcher, exporter, time.Second)
-		pusher.Start()
-		global.SetMeterProvider(pusher)
-	} else {
-		log.Info("No New Relic API key found, defaulting to stdout exporter")
-		// Create stdout exporter to be able to retrieve
-		// the collected spans.
-		exporter, err := stdout.NewExporter(stdout.Options{PrettyPrint: true})
-		if err != nil {
-			log.Fatal(err)
+// healthzHandler reports ok as long as the frontend process itself can serve
+// traffic. It still surfaces per-backend health (via connManager.Healthy) in the
+// body so a prober or operator can see a degraded backend without the probe
+// itself flapping the pod; it only fails the probe if every backend is down, since
+// at that point the frontend can't do anything useful either.
+func (fe *frontendServer) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	unhealthy := []string{}
+	for name, mgr := range fe.backends() {
+		if mgr.Conn() == nil || !mgr.Healthy() {
+			unhealthy = append(unhealthy, name)
 		}
+	}
 
-		// For the demonstration, use sdktrace.AlwaysSample sampler to sample all traces.
-		// In a production application, use sdktrace.ProbabilitySampler with a desired probability.
-		tp, err := trace.NewProvider(trace.WithConfig(trace.Config{DefaultSampler: trace.AlwaysSample()}),
-			trace.WithSyncer(exporter))
-		if err != nil {
-			log.Fatal(err)
-		}
-		global.SetTraceProvider(tp)
-		// TODO: use stdout exporter
+	if len(unhealthy) == len(fe.backends()) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "all backends unhealthy: %v\n", unhealthy)
+		return
 	}
+	if len(unhealthy) > 0 {
+		fmt.Fprintf(w, "ok (degraded backends: %v)\n", unhealthy)
+		return
+	}
+	fmt.Fprint(w, "ok\n")
 }
 
 func mustMapEnv(target *string, envKey string) {
@@ -258,15 +228,24 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
-	var err error
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
-		grpc.WithTimeout(time.Second*3),
-		grpc.WithUnaryInterceptor(grpctrace.UnaryClientInterceptor(global.Tracer("Frontend"))),
-		grpc.WithStreamInterceptor(grpctrace.StreamClientInterceptor(global.Tracer("Frontend"))),
-	)
+// mustNewConnManager builds the connManager for a backend service, reading optional
+// TLS/mTLS material from <PREFIX>_TLS_CA/_CERT/_KEY, where PREFIX is addrEnvKey with
+// its "_ADDR" suffix stripped (e.g. PRODUCT_CATALOG_SERVICE_ADDR -> ..._TLS_CA) so the
+// TLS env vars line up with the already-documented *_ADDR ones instead of being
+// re-derived from the (differently formatted) logging name. It panics if the initial
+// connection attempt, including its retries, never succeeds.
+func mustNewConnManager(ctx context.Context, log logrus.FieldLogger, name, addrEnvKey, addr string) *connManager {
+	envPrefix := strings.TrimSuffix(addrEnvKey, "_ADDR")
+	cfg := connManagerConfig{
+		Name:     name,
+		Addr:     addr,
+		CAFile:   os.Getenv(envPrefix + "_TLS_CA"),
+		CertFile: os.Getenv(envPrefix + "_TLS_CERT"),
+		KeyFile:  os.Getenv(envPrefix + "_TLS_KEY"),
+	}
+	m, err := newConnManager(ctx, log, cfg)
 	if err != nil {
-		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
+		panic(err)
 	}
+	return m
 }
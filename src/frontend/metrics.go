@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	export "go.opentelemetry.io/otel/sdk/export/metric"
+	"go.opentelemetry.io/otel/sdk/export/metric/aggregation"
+)
+
+const defaultMetricsListenAddr = "127.0.0.1:9090"
+
+// latencyBucketBoundariesMs are the histogram boundaries for http_request_latency,
+// chosen to give usable p50/p95/p99 resolution in Grafana. initTracing applies them
+// to metricCheckpointer, so both the OTLP push exporter and the /metrics endpoint
+// below see the same bucketed data.
+var latencyBucketBoundariesMs = []float64{5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 10000}
+
+// maybeStartMetricsServer serves metricCheckpointer - the same checkpointer
+// initTracing's push controller already reads from - on a Prometheus-scrapeable
+// /metrics endpoint when ENABLE_METRICS is set. It's bound to loopback by default
+// (METRICS_LISTEN_ADDR) so metrics aren't exposed on the public shopping port.
+//
+// This is an additional reader of the existing instrumentation, not a second set of
+// instruments: http_request_count/http_request_latency/http_error_count are recorded
+// once, by telemetryHandler, and exported two ways (periodically pushed via OTLP, and
+// pulled here on scrape) from that single source of truth.
+func maybeStartMetricsServer(log logrus.FieldLogger) {
+	if os.Getenv("ENABLE_METRICS") == "" {
+		return
+	}
+	if metricCheckpointer == nil {
+		log.Warn("ENABLE_METRICS set but no metric checkpointer is active (tracing disabled or not yet initialized); /metrics will not be served")
+		return
+	}
+
+	addr := getEnvWithDefault("METRICS_LISTEN_ADDR", defaultMetricsListenAddr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", servePrometheusCheckpoint)
+	go func() {
+		log.Infof("serving Prometheus metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.WithError(err).Error("Prometheus metrics server stopped")
+		}
+	}()
+}
+
+// servePrometheusCheckpoint renders metricCheckpointer's current state - last
+// updated by the push controller's own collect cycle, so at most one push interval
+// stale - in Prometheus text exposition format.
+func servePrometheusCheckpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := metricCheckpointer.ForEach(export.CumulativeExportKindSelector(), func(rec export.Record) error {
+		return writePrometheusRecord(w, rec)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writePrometheusRecord formats a single aggregated record as one or more
+// Prometheus exposition lines, depending on its aggregation kind.
+func writePrometheusRecord(w http.ResponseWriter, rec export.Record) error {
+	name := rec.Descriptor().Name()
+
+	switch agg := rec.Aggregation().(type) {
+	case aggregation.Sum:
+		sum, err := agg.Sum()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %d\n", name, sum.AsInt64())
+	case aggregation.Histogram:
+		buckets, err := agg.Histogram()
+		if err != nil {
+			return err
+		}
+		var cumulative uint64
+		for i, boundary := range buckets.Boundaries {
+			cumulative += uint64(buckets.Counts[i])
+			fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, boundary, cumulative)
+		}
+		if n := len(buckets.Counts); n > 0 {
+			cumulative += uint64(buckets.Counts[n-1])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	}
+	return nil
+}
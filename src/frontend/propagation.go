@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/api/core"
+	"go.opentelemetry.io/otel/api/correlation"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/key"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// setGlobalPropagators registers the W3C tracecontext (traceparent/tracestate) and
+// baggage propagators globally, so both the incoming HTTP middleware and the outbound
+// gRPC interceptors agree on how to (de)serialize trace context. Without this, a
+// frontend instance talking to services built on a different SDK/language may not
+// join the same trace.
+func setGlobalPropagators() {
+	global.SetPropagators(propagation.New(
+		propagation.WithExtractors(trace.TraceContext{}, correlation.CorrelationContext{}),
+		propagation.WithInjectors(trace.TraceContext{}, correlation.CorrelationContext{}),
+	))
+}
+
+// propagationHandler extracts the W3C trace context and baggage from the incoming
+// HTTP request and starts a span for it, so that span becomes the parent of any
+// outbound gRPC calls the handler chain makes. It also injects the session ID and
+// currency as baggage so downstream services (cart, currency, checkout, ...) can
+// attribute spans without the caller re-plumbing that request metadata through
+// every gRPC call.
+type propagationHandler struct {
+	next http.Handler
+}
+
+func (h *propagationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := global.Propagators().Extract(r.Context(), r.Header)
+
+	baggage := make([]core.KeyValue, 0, 2)
+	if sessionID, ok := ctx.Value(ctxKeySessionID{}).(string); ok && sessionID != "" {
+		baggage = append(baggage, key.New("session.id").String(sessionID))
+	}
+	if c, err := r.Cookie(cookieCurrency); err == nil && c.Value != "" {
+		baggage = append(baggage, key.New("currency").String(c.Value))
+	}
+	if len(baggage) > 0 {
+		ctx = correlation.NewContext(ctx, baggage...)
+	}
+
+	ctx, span := global.Tracer("frontend").Start(ctx, "http."+r.Method+" "+r.URL.Path)
+	defer span.End()
+
+	h.next.ServeHTTP(w, r.WithContext(ctx))
+}
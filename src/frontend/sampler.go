@@ -0,0 +1,162 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// SamplerConfig controls how the frontend decides which traces to export. It's built
+// from the OTEL_TRACES_SAMPLER / OTEL_TRACES_SAMPLER_ARG env vars so sampling can be
+// tuned per-environment without a code change.
+type SamplerConfig struct {
+	// Kind is one of "always_on", "always_off", "traceidratio", "parentbased_traceidratio".
+	Kind string
+	// Arg is the sampler argument, e.g. the ratio for the traceidratio samplers.
+	Arg float64
+	// MaxSpansPerSecond, when > 0, wraps the configured sampler in a rate-limiting
+	// sampler so a load-tested frontend can't flood the collector.
+	MaxSpansPerSecond float64
+}
+
+// samplerConfigFromEnv reads OTEL_TRACES_SAMPLER, OTEL_TRACES_SAMPLER_ARG and
+// OTEL_TRACES_SAMPLER_RATE_LIMIT, defaulting to always-on sampling to preserve the
+// demo's existing "trace everything" behavior when nothing is set.
+func samplerConfigFromEnv() SamplerConfig {
+	cfg := SamplerConfig{Kind: getEnvWithDefault("OTEL_TRACES_SAMPLER", "always_on"), Arg: 1}
+	if arg := getEnvWithDefault("OTEL_TRACES_SAMPLER_ARG", ""); arg != "" {
+		if v, err := strconv.ParseFloat(arg, 64); err == nil {
+			cfg.Arg = v
+		}
+	}
+	if rate := getEnvWithDefault("OTEL_TRACES_SAMPLER_RATE_LIMIT", ""); rate != "" {
+		if v, err := strconv.ParseFloat(rate, 64); err == nil {
+			cfg.MaxSpansPerSecond = v
+		}
+	}
+	return cfg
+}
+
+// buildSampler turns a SamplerConfig into a trace.Sampler, wrapping it in a rate
+// limiter when MaxSpansPerSecond is set.
+func buildSampler(log logrus.FieldLogger, cfg SamplerConfig) trace.Sampler {
+	var sampler trace.Sampler
+	switch cfg.Kind {
+	case "always_off":
+		sampler = trace.NeverSample()
+	case "traceidratio":
+		sampler = trace.ProbabilitySampler(cfg.Arg)
+	case "parentbased_traceidratio":
+		sampler = parentBased(trace.ProbabilitySampler(cfg.Arg))
+	case "always_on":
+		sampler = trace.AlwaysSample()
+	default:
+		log.Warnf("unknown OTEL_TRACES_SAMPLER %q, defaulting to always_on", cfg.Kind)
+		sampler = trace.AlwaysSample()
+	}
+
+	if cfg.MaxSpansPerSecond > 0 {
+		sampler = newRateLimitingSampler(sampler, cfg.MaxSpansPerSecond)
+	}
+	return sampler
+}
+
+// parentBasedSampler delegates to root for spans with no valid parent, and
+// otherwise follows the parent's sampling decision (sampled or not) so a trace isn't split
+// across export backends mid-flight.
+type parentBasedSampler struct {
+	root trace.Sampler
+}
+
+func parentBased(root trace.Sampler) trace.Sampler {
+	return &parentBasedSampler{root: root}
+}
+
+func (s *parentBasedSampler) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	if p.ParentContext.IsValid() {
+		if p.ParentContext.IsSampled() {
+			return trace.SamplingResult{Decision: trace.RecordAndSampled, Tracestate: p.ParentContext.TraceState()}
+		}
+		return trace.SamplingResult{Decision: trace.NotRecord, Tracestate: p.ParentContext.TraceState()}
+	}
+	return s.root.ShouldSample(p)
+}
+
+func (s *parentBasedSampler) Description() string {
+	return fmt.Sprintf("ParentBased{%s}", s.root.Description())
+}
+
+// rateLimitingSampler caps the number of spans sampled per second using a token
+// bucket, regardless of what the wrapped sampler decides. This protects the
+// collector from being flooded during load tests, where always_on or a high
+// traceidratio would otherwise produce unbounded span volume.
+type rateLimitingSampler struct {
+	delegate trace.Sampler
+
+	mu         sync.Mutex
+	tokens     float64
+	maxTokens  float64
+	refillRate float64 // tokens per second
+	lastRefill time.Time
+}
+
+func newRateLimitingSampler(delegate trace.Sampler, spansPerSecond float64) *rateLimitingSampler {
+	return &rateLimitingSampler{
+		delegate:   delegate,
+		tokens:     spansPerSecond,
+		maxTokens:  spansPerSecond,
+		refillRate: spansPerSecond,
+		lastRefill: time.Now(),
+	}
+}
+
+func (s *rateLimitingSampler) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	result := s.delegate.ShouldSample(p)
+	if result.Decision != trace.RecordAndSampled {
+		return result
+	}
+	if !s.allow() {
+		result.Decision = trace.NotRecord
+	}
+	return result
+}
+
+func (s *rateLimitingSampler) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.lastRefill).Seconds()
+	s.lastRefill = now
+	s.tokens += elapsed * s.refillRate
+	if s.tokens > s.maxTokens {
+		s.tokens = s.maxTokens
+	}
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+func (s *rateLimitingSampler) Description() string {
+	return fmt.Sprintf("RateLimiting{%s,maxSpansPerSecond=%.1f}", s.delegate.Description(), s.maxTokens)
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/api/core"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// sampledParentContext returns a valid parent SpanContext, sampled or not. 0x1 is
+// the W3C traceparent "sampled" flag bit that TraceFlags encodes.
+func sampledParentContext(sampled bool) core.SpanContext {
+	sc := core.SpanContext{TraceID: core.TraceID{1}, SpanID: core.SpanID{1}}
+	if sampled {
+		sc.TraceFlags = 1
+	}
+	return sc
+}
+
+func TestParentBasedSampler_NoParent_DefersToRoot(t *testing.T) {
+	s := parentBased(trace.NeverSample())
+	got := s.ShouldSample(trace.SamplingParameters{}).Decision
+	if got != trace.NotRecord {
+		t.Errorf("ShouldSample with no parent = %v, want root's NotRecord", got)
+	}
+}
+
+func TestParentBasedSampler_SampledParent_Overrides(t *testing.T) {
+	// root would say no; a sampled parent should win anyway.
+	s := parentBased(trace.NeverSample())
+	got := s.ShouldSample(trace.SamplingParameters{ParentContext: sampledParentContext(true)}).Decision
+	if got != trace.RecordAndSampled {
+		t.Errorf("ShouldSample with sampled parent = %v, want RecordAndSampled", got)
+	}
+}
+
+func TestParentBasedSampler_UnsampledParent_Overrides(t *testing.T) {
+	// root would say yes; an unsampled parent should win anyway.
+	s := parentBased(trace.AlwaysSample())
+	got := s.ShouldSample(trace.SamplingParameters{ParentContext: sampledParentContext(false)}).Decision
+	if got != trace.NotRecord {
+		t.Errorf("ShouldSample with unsampled parent = %v, want NotRecord", got)
+	}
+}
+
+func TestRateLimitingSampler_CapsBurstThroughput(t *testing.T) {
+	const spansPerSecond = 5
+	s := newRateLimitingSampler(trace.AlwaysSample(), spansPerSecond)
+
+	sampled := 0
+	for i := 0; i < 100; i++ {
+		if s.ShouldSample(trace.SamplingParameters{}).Decision == trace.RecordAndSampled {
+			sampled++
+		}
+	}
+	if sampled > spansPerSecond+1 {
+		t.Errorf("sampled %d of 100 back-to-back spans, want at most ~%d before any refill elapses", sampled, spansPerSecond)
+	}
+	if sampled == 0 {
+		t.Error("sampled 0 spans, want the initial token bucket to allow at least one")
+	}
+}
+
+func TestRateLimitingSampler_NeverOverridesDelegateDrop(t *testing.T) {
+	s := newRateLimitingSampler(trace.NeverSample(), 100)
+	got := s.ShouldSample(trace.SamplingParameters{}).Decision
+	if got != trace.NotRecord {
+		t.Errorf("ShouldSample with a NeverSample delegate = %v, want NotRecord regardless of rate limit", got)
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"single pair", "api-key=secret", map[string]string{"api-key": "secret"}},
+		{"multiple pairs with spaces", "api-key=secret, x-env = prod", map[string]string{"api-key": "secret", "x-env": "prod"}},
+		{"malformed entries are skipped", "api-key=secret,malformed,x-env=prod", map[string]string{"api-key": "secret", "x-env": "prod"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseOTLPHeaders(tc.raw)
+			if len(got) != len(tc.want) {
+				t.Fatalf("parseOTLPHeaders(%q) = %v, want %v", tc.raw, got, tc.want)
+			}
+			for k, want := range tc.want {
+				if got[k] != want {
+					t.Errorf("parseOTLPHeaders(%q)[%q] = %q, want %q", tc.raw, k, got[k], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/key"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	export "go.opentelemetry.io/otel/sdk/export/metric"
+	"go.opentelemetry.io/otel/sdk/metric/batcher/ungrouped"
+	"go.opentelemetry.io/otel/sdk/metric/controller/push"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+const defaultServiceName = "frontend"
+
+var pusher *push.Controller
+
+// metricCheckpointer is the single aggregation store backing every meter created
+// from global.MeterProvider(): the push controller above drains it into the OTLP
+// exporter every push interval, and maybeStartMetricsServer (metrics.go) reads the
+// exact same checkpointer on every Prometheus scrape. There's one set of
+// instruments recorded once; this just gives it two export paths.
+var metricCheckpointer export.Checkpointer
+
+// initTracing wires up trace and metric export to an OpenTelemetry Collector via OTLP,
+// configured entirely through the env vars from the OpenTelemetry spec
+// (OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_PROTOCOL, OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_SERVICE_NAME). Any collector-compatible backend works here (Jaeger, Tempo, New Relic,
+// Prometheus via the collector, ...) so the frontend is no longer wired to one vendor SDK.
+// When no endpoint is configured it falls back to the stdout exporter.
+func initTracing(log logrus.FieldLogger) {
+	setGlobalPropagators()
+
+	endpoint := getEnvWithDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if endpoint == "" {
+		log.Info("No OTEL_EXPORTER_OTLP_ENDPOINT set, defaulting to stdout exporter")
+		initStdoutTracing(log)
+		return
+	}
+
+	protocol := getEnvWithDefault("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	headers := parseOTLPHeaders(getEnvWithDefault("OTEL_EXPORTER_OTLP_HEADERS", ""))
+	serviceName := getEnvWithDefault("OTEL_SERVICE_NAME", defaultServiceName)
+
+	log.Infof("Exporting traces and metrics via OTLP/%s to %s", protocol, endpoint)
+
+	exporter, err := newOTLPExporter(context.Background(), protocol, endpoint, headers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	res := resource.New(key.New("service.name").String(serviceName))
+	sampler := buildSampler(log, samplerConfigFromEnv())
+
+	tp, err := trace.NewProvider(
+		trace.WithConfig(trace.Config{DefaultSampler: sampler, Resource: res}),
+		trace.WithSyncer(exporter),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	global.SetTraceProvider(tp)
+
+	initMetrics(exporter)
+}
+
+// newOTLPExporter builds the OTLP exporter for the requested protocol. "grpc" is the
+// default and most efficient transport; "http" and "http/protobuf" are provided for
+// collectors or networks where gRPC isn't an option.
+func newOTLPExporter(ctx context.Context, protocol, endpoint string, headers map[string]string) (*otlp.Exporter, error) {
+	switch protocol {
+	case "http", "http/protobuf":
+		driver := otlphttp.NewDriver(
+			otlphttp.WithEndpoint(endpoint),
+			otlphttp.WithHeaders(headers),
+		)
+		return otlp.NewExporter(ctx, driver)
+	default:
+		return otlp.NewExporter(ctx,
+			otlp.WithAddress(endpoint),
+			otlp.WithInsecure(),
+			otlp.WithHeaders(headers),
+		)
+	}
+}
+
+// parseOTLPHeaders parses the comma-separated key=value list described by the
+// OTEL_EXPORTER_OTLP_HEADERS spec, e.g. "api-key=secret,x-env=prod".
+func parseOTLPHeaders(raw string) map[string]string {
+	headers := map[string]string{}
+	if raw == "" {
+		return headers
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers
+}
+
+// initStdoutTracing is the zero-config fallback used when no collector endpoint is set.
+// Metrics are still collected (initMetrics), just with nowhere to push them, so
+// ENABLE_METRICS's Prometheus endpoint (metrics.go) works even without an OTLP
+// destination configured.
+func initStdoutTracing(log logrus.FieldLogger) {
+	exporter, err := stdout.NewExporter(stdout.Options{PrettyPrint: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sampler := buildSampler(log, samplerConfigFromEnv())
+	tp, err := trace.NewProvider(trace.WithConfig(trace.Config{DefaultSampler: sampler}),
+		trace.WithSyncer(exporter))
+	if err != nil {
+		log.Fatal(err)
+	}
+	global.SetTraceProvider(tp)
+
+	initMetrics(noopMetricExporter{export.CumulativeExportKindSelector()})
+}
+
+// initMetrics builds the SDK meter/checkpointer backing every instrument created from
+// global.MeterProvider(), and starts it ticking into exporter. metricCheckpointer
+// (read by maybeStartMetricsServer in metrics.go) is populated unconditionally here -
+// by both callers above - so the Prometheus pull endpoint works whether or not an
+// OTLP push destination is configured.
+func initMetrics(exporter export.Exporter) {
+	selector := simple.NewWithHistogramDistribution(latencyBucketBoundariesMs)
+	metricCheckpointer = ungrouped.New(selector, true)
+	pusher = push.New(metricCheckpointer, exporter, time.Second)
+	pusher.Start()
+	global.SetMeterProvider(pusher)
+}
+
+// noopMetricExporter discards every collected checkpoint instead of pushing it
+// anywhere. Used by initStdoutTracing so the push controller still ticks and
+// populates metricCheckpointer even when there's no OTLP destination to export to.
+type noopMetricExporter struct {
+	export.ExportKindSelector
+}
+
+func (noopMetricExporter) Export(context.Context, export.CheckpointSet) error {
+	return nil
+}
+
+func getEnvWithDefault(envKey, def string) string {
+	if v := os.Getenv(envKey); v != "" {
+		return v
+	}
+	return def
+}